@@ -1,12 +1,16 @@
 package spread
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,25 +24,29 @@ func Linode(b *Backend) Provider {
 type linode struct {
 	backend *Backend
 
-	distrosLock  sync.Mutex
-	distrosDone  bool
-	distrosCache []*linodeDistro
-	kernelsCache []*linodeKernel
+	distrosLock   sync.Mutex
+	distrosDone   bool
+	imagesCache   []*linodeImage
+	kernelsCache  []*linodeKernel
+	genericKernel string
 }
 
-var client = &http.Client{}
+var client = &http.Client{Timeout: 30 * time.Second}
+
+const linodeBaseURL = "https://api.linode.com/v4"
 
 type linodeServer struct {
 	l *linode
 
-	ID     int     `json:"LINODEID"`
-	Label  string  `json:"LABEL"`
-	Status int     `json:"STATUS" yaml:"-"`
-	Addr   string  `json:"-" yaml:"address"`
-	Img    ImageID `json:"-" yaml:"image"`
-	Config int     `json:"-"`
-	Root   int     `json:"-"`
-	Swap   int     `json:"-"`
+	ID     int      `json:"id"`
+	Label  string   `json:"label"`
+	Status string   `json:"status" yaml:"-"`
+	Tags   []string `json:"tags" yaml:"tags,omitempty"`
+	Addr   string   `json:"-" yaml:"address"`
+	Img    ImageID  `json:"-" yaml:"image"`
+	Config int      `json:"-"`
+	Root   int      `json:"-"`
+	Swap   int      `json:"-"`
 }
 
 func (s *linodeServer) String() string {
@@ -58,7 +66,39 @@ func (s *linodeServer) Image() ImageID {
 }
 
 func (s *linodeServer) Snapshot() (ImageID, error) {
-	return "", nil
+	l := s.l
+	ctx := context.Background()
+
+	event, err := l.shutdown(ctx, s)
+	if err != nil {
+		return "", err
+	}
+	if err := l.waitEvent(ctx, s, "shutdown", event, l.waitBudget()); err != nil {
+		return "", err
+	}
+
+	logf("Creating Linode image from %s...", s)
+	var result struct {
+		linodeResult
+		ID string `json:"id"`
+	}
+	err = l.do(ctx, "POST", "/images", nil, linodeParams{
+		"disk_id":     s.Root,
+		"label":       s.Img.Label("snapshot"),
+		"description": fmt.Sprintf("spread snapshot of %s", s.Img),
+	}, &result)
+	if err == nil {
+		err = result.err()
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot create Linode image from %s: %v", s, err)
+	}
+
+	id, err := l.waitImage(ctx, result.ID)
+	if err != nil {
+		return "", err
+	}
+	return ImageID(id), nil
 }
 
 func (s *linodeServer) ReuseData() []byte {
@@ -70,24 +110,30 @@ func (s *linodeServer) ReuseData() []byte {
 }
 
 const (
-	linodeBeingCreated = -1
-	linodeBrandNew     = 0
-	linodeRunning      = 1
-	linodePoweredOff   = 2
+	linodeStatusProvisioning = "provisioning"
+	linodeStatusBooting      = "booting"
+	linodeStatusRunning      = "running"
+	linodeStatusOffline      = "offline"
+	linodeStatusShuttingDown = "shutting_down"
+	linodeStatusRebooting    = "rebooting"
+	linodeStatusDeleting     = "deleting"
 )
 
 type linodeResult struct {
-	Errors []linodeError `json:"ERRORARRAY"`
+	Errors []linodeError `json:"errors"`
 }
 
 type linodeError struct {
-	Code    int    `json:"ERRORCODE"`
-	Message string `json:"ERRORMESSAGE"`
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
 }
 
 func (r *linodeResult) err() error {
 	for _, e := range r.Errors {
-		return fmt.Errorf("%s", strings.ToLower(string(e.Message[0]))+e.Message[1:])
+		if e.Field != "" {
+			return fmt.Errorf("%s: %s", e.Field, e.Reason)
+		}
+		return fmt.Errorf("%s", e.Reason)
 	}
 	return nil
 }
@@ -97,9 +143,42 @@ func (l *linode) Backend() *Backend {
 }
 
 func (l *linode) DiscardSnapshot(image ImageID) error {
+	logf("Discarding snapshot %s...", image)
+	err := l.do(context.Background(), "DELETE", "/images/"+string(image), nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("cannot discard Linode image %s: %v", image, err)
+	}
 	return nil
 }
 
+func (l *linode) waitImage(ctx context.Context, id string) (string, error) {
+	logf("Waiting for image %s to become available...", id)
+
+	timeout := time.After(5 * time.Minute)
+	retry := time.NewTicker(5 * time.Second)
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-timeout:
+			return "", fmt.Errorf("timeout waiting for image %s to become available", id)
+
+		case <-retry.C:
+			var result struct {
+				linodeResult
+				Status string `json:"status"`
+			}
+			err := l.do(ctx, "GET", "/images/"+id, nil, nil, &result)
+			if err != nil {
+				continue
+			}
+			if result.Status == "available" {
+				return id, nil
+			}
+		}
+	}
+}
+
 func (l *linode) Reuse(data []byte, password string) (Server, error) {
 	server := &linodeServer{}
 	err := yaml.Unmarshal(data, server)
@@ -114,26 +193,133 @@ type FatalError struct {
 	error
 }
 
+const linodeSpreadTag = "spread"
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
 func (l *linode) Allocate(image ImageID, password string) (Server, error) {
-	servers, err := l.list()
+	ctx := context.Background()
+
+	servers, err := l.list(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if len(servers) == 0 {
-		return nil, FatalError{fmt.Errorf("no servers in Linode account")}
-	}
 	for _, server := range servers {
-		if server.Status != linodePoweredOff {
+		if server.Status != linodeStatusOffline {
 			continue
 		}
-		err := l.setup(server, image, password)
+		err := l.setup(ctx, server, image, password)
 		if err != nil {
 			return nil, err
 		}
 		printf("Allocated %s.", server)
 		return server, nil
 	}
-	return nil, fmt.Errorf("no powered off servers in Linode account")
+
+	if l.backend.MaxInstances == 0 {
+		if len(servers) == 0 {
+			return nil, FatalError{fmt.Errorf("no servers in Linode account")}
+		}
+		return nil, fmt.Errorf("no powered off servers in Linode account")
+	}
+
+	var managed int
+	for _, server := range servers {
+		if hasTag(server.Tags, linodeSpreadTag) {
+			managed++
+		}
+	}
+	if managed >= l.backend.MaxInstances {
+		return nil, fmt.Errorf("already %d Linode instances managed by spread, see max-instances", managed)
+	}
+
+	server, err := l.create(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.setup(ctx, server, image, password); err != nil {
+		l.destroy(ctx, server)
+		return nil, err
+	}
+	printf("Allocated %s.", server)
+	return server, nil
+}
+
+func (l *linode) create(ctx context.Context, image ImageID) (*linodeServer, error) {
+	logf("Creating Linode instance with %s...", image)
+
+	var result struct {
+		linodeResult
+		linodeServer
+	}
+	err := l.do(ctx, "POST", "/linode/instances", nil, linodeParams{
+		"type":   l.backend.Plan,
+		"region": l.backend.Region,
+		"label":  image.Label(""),
+		"booted": false,
+		"tags":   []string{linodeSpreadTag},
+	}, &result)
+	if err == nil {
+		err = result.err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot create Linode instance with %s: %v", image, err)
+	}
+	server := &result.linodeServer
+	server.l = l
+
+	if err := l.waitOffline(ctx, server); err != nil {
+		l.destroy(ctx, server)
+		return nil, err
+	}
+	return server, nil
+}
+
+const linodeProvisionTimeout = 5 * time.Minute
+
+// waitOffline polls a newly created instance until it leaves "provisioning"
+// and reaches "offline", since disk creation against a still-provisioning
+// Linode can fail intermittently.
+func (l *linode) waitOffline(ctx context.Context, server *linodeServer) error {
+	logf("Waiting for %s to finish provisioning...", server)
+
+	timeout := time.After(linodeProvisionTimeout)
+	retry := time.NewTicker(5 * time.Second)
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-timeout:
+			return fmt.Errorf("timeout waiting for %s to finish provisioning", server)
+
+		case <-retry.C:
+			var result linodeServer
+			err := l.do(ctx, "GET", fmt.Sprintf("/linode/instances/%d", server.ID), nil, nil, &result)
+			if err != nil {
+				continue
+			}
+			server.Status = result.Status
+			if result.Status == linodeStatusOffline {
+				return nil
+			}
+		}
+	}
+}
+
+func (l *linode) destroy(ctx context.Context, server *linodeServer) error {
+	logf("Deleting %s...", server)
+	err := l.do(ctx, "DELETE", fmt.Sprintf("/linode/instances/%d", server.ID), nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("cannot delete %s: %v", server, err)
+	}
+	return nil
 }
 
 func firstErr(errs ...error) error {
@@ -147,548 +333,617 @@ func firstErr(errs ...error) error {
 
 func (s *linodeServer) Discard() error {
 	logf("Discarding %s...", s)
-	_, err1 := s.l.shutdown(s)
-	err2 := s.l.removeConfig(s, s.Config)
-	err3 := s.l.removeDisks(s, s.Root, s.Swap)
+	ctx := context.Background()
+	if hasTag(s.Tags, linodeSpreadTag) && !s.l.backend.Reserved {
+		return s.l.destroy(ctx, s)
+	}
+	_, err1 := s.l.shutdown(ctx, s)
+	err2 := s.l.removeConfig(ctx, s, s.Config)
+	err3 := s.l.removeDisks(ctx, s, s.Root, s.Swap)
 	return firstErr(err1, err2, err3)
 }
 
-type linodeListResult struct {
-	Data []*linodeServer `json:"DATA"`
-}
-
-func (l *linode) list() ([]*linodeServer, error) {
-	log("Listing available Linode servers...")
-	params := linodeParams{
-		"api_action": "linode.list",
+func (l *linode) list(ctx context.Context) ([]*linodeServer, error) {
+	log("Listing available Linode instances...")
+	var result struct {
+		linodeResult
+		Data []*linodeServer `json:"data"`
+	}
+	err := l.do(ctx, "GET", "/linode/instances", nil, nil, &result)
+	if err == nil {
+		err = result.err()
 	}
-	var result linodeListResult
-	err := l.do(params, &result)
 	if err != nil {
 		return nil, err
 	}
 	return result.Data, nil
 }
 
-func (l *linode) setup(server *linodeServer, image ImageID, password string) error {
+func (l *linode) setup(ctx context.Context, server *linodeServer, image ImageID, password string) error {
 	server.l = l
 	server.Img = image
 
-	ip, err := l.ip(server)
+	addr, err := l.ip(ctx, server)
 	if err != nil {
 		return err
 	}
-	server.Addr = ip.IPAddress
+	server.Addr = addr
 
-	rootJob, swapJob, err := l.createDisk(server, image, password)
+	rootID, swapID, err := l.createDisk(ctx, server, image, password)
 	if err != nil {
 		return err
 	}
-	server.Root = rootJob.DiskID
-	server.Swap = swapJob.DiskID
+	server.Root = rootID
+	server.Swap = swapID
 
-	configID, err := l.createConfig(server, image, server.Root, server.Swap)
+	configID, err := l.createConfig(ctx, server, image, server.Root, server.Swap)
 	if err != nil {
-		l.removeDisks(server, server.Root, server.Swap)
+		l.removeDisks(ctx, server, server.Root, server.Swap)
 		return err
 	}
 	server.Config = configID
 
-	bootJob, err := l.boot(server, configID)
+	event, err := l.boot(ctx, server, configID)
 	if err == nil {
-		_, err = l.waitJob(server, "boot", bootJob.JobID)
+		err = l.waitEvent(ctx, server, "boot", event, l.waitBudget())
 	}
 	if err != nil {
-		l.removeConfig(server, server.Config)
-		l.removeDisks(server, server.Root, server.Swap)
+		// Don't shutdown. The machine may be running something else.
+		l.removeConfig(ctx, server, server.Config)
+		l.removeDisks(ctx, server, server.Root, server.Swap)
 		return err
 	}
 	return nil
 }
 
-type linodeJob struct {
-	JobID int `json:"JOBID"`
+type linodeEvent struct {
+	ID      int    `json:"id"`
+	Action  string `json:"action"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
 }
 
-type linodeJobResult struct {
-	linodeResult
-	Data *linodeJob `json:"DATA"`
+// linodeWaitPadding is added on top of a single do retry budget to get the
+// wait budget for polling an event to completion (see waitBudget). Each poll
+// inside waitEvent calls do, which can itself retry transient failures for
+// up to its own budget before returning; if waitEvent's deadline were
+// shorter than, or close to, that, a single slow poll could block well past
+// the deadline before waitEvent's select ever got a chance to time out.
+const linodeWaitPadding = 1 * time.Minute
+
+// waitBudget returns how long waitEvent should wait for an operation to
+// finish, comfortably longer than a single do call's own retry budget.
+func (l *linode) waitBudget() time.Duration {
+	budget := l.backend.RetryTimeout
+	if budget == 0 {
+		budget = linodeRetryBudget
+	}
+	return budget + linodeWaitPadding
 }
 
-func (l *linode) boot(server *linodeServer, configID int) (*linodeJob, error) {
-	return l.serverJob(server, "reboot", linodeParams{
-		"api_action": "linode.reboot",
-		"LinodeID":   server.ID,
-		"ConfigID":   configID,
-	})
+func (l *linode) boot(ctx context.Context, server *linodeServer, configID int) (*linodeEvent, error) {
+	return l.serverAction(ctx, server, "boot", "boot", "linode_boot", linodeParams{"config_id": configID})
 }
 
-func (l *linode) reboot(server *linodeServer, configID int) (*linodeJob, error) {
-	return l.serverJob(server, "reboot", linodeParams{
-		"api_action": "linode.reboot",
-		"LinodeID":   server.ID,
-		"ConfigID":   configID,
-	})
+func (l *linode) reboot(ctx context.Context, server *linodeServer, configID int) (*linodeEvent, error) {
+	return l.serverAction(ctx, server, "reboot", "reboot", "linode_reboot", linodeParams{"config_id": configID})
 }
 
-func (l *linode) shutdown(server *linodeServer) (*linodeJob, error) {
-	return l.serverJob(server, "shutdown", linodeParams{
-		"api_action": "linode.shutdown",
-		"LinodeID":   server.ID,
-	})
+func (l *linode) shutdown(ctx context.Context, server *linodeServer) (*linodeEvent, error) {
+	return l.serverAction(ctx, server, "shutdown", "shutdown", "linode_shutdown", nil)
 }
 
-func (l *linode) serverJob(server *linodeServer, verb string, params linodeParams) (*linodeJob, error) {
-	var result linodeJobResult
-	err := l.do(params, &result)
-	if err == nil {
-		err = result.err()
+func (l *linode) serverAction(ctx context.Context, server *linodeServer, verb, path, eventAction string, body interface{}) (*linodeEvent, error) {
+	// Event IDs are assigned in increasing order by Linode, so recording the
+	// most recent existing event for this action before triggering it lets
+	// findEvent look only at what comes after - otherwise, on a reused
+	// server, the most recent event for the action would be a prior,
+	// already-finished one, and waitEvent would return immediately without
+	// waiting for this call's operation to complete.
+	lastID, err := l.lastEventID(ctx, server, eventAction)
+	if err != nil {
+		return nil, fmt.Errorf("cannot %s %s: %v", verb, server, err)
 	}
+
+	err = l.do(ctx, "POST", fmt.Sprintf("/linode/instances/%d/%s", server.ID, path), nil, body, nil)
 	if err != nil {
 		return nil, fmt.Errorf("cannot %s %s: %v", verb, server, err)
 	}
-	return result.Data, nil
+	event, err := l.findEvent(ctx, server, eventAction, lastID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot %s %s: %v", verb, server, err)
+	}
+	return event, nil
 }
 
-type linodeDiskJob struct {
-	DiskID int `json:"DISKID"`
-	JobID  int `json:"JOBID"`
+func (l *linode) lastEventID(ctx context.Context, server *linodeServer, action string) (int, error) {
+	filter := fmt.Sprintf(`{"entity.id":%d,"entity.type":"linode","action":%q,"+order_by":"id","+order":"desc"}`, server.ID, action)
+	var result struct {
+		linodeResult
+		Data []*linodeEvent `json:"data"`
+	}
+	err := l.do(ctx, "GET", "/account/events", map[string]string{"X-Filter": filter}, nil, &result)
+	if err == nil {
+		err = result.err()
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(result.Data) == 0 {
+		return 0, nil
+	}
+	return result.Data[0].ID, nil
 }
 
-type linodeDiskJobResult struct {
-	linodeResult
-	Data *linodeDiskJob `json:"DATA"`
+// findEvent locates the event this call's action produced: the earliest
+// event for action with an ID greater than afterID. The event may not be
+// queryable the instant the triggering request returns, so this polls for a
+// short while rather than looking up once.
+func (l *linode) findEvent(ctx context.Context, server *linodeServer, action string, afterID int) (*linodeEvent, error) {
+	filter := fmt.Sprintf(`{"entity.id":%d,"entity.type":"linode","action":%q,"id":{"+gt":%d},"+order_by":"id","+order":"asc"}`, server.ID, action, afterID)
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		var result struct {
+			linodeResult
+			Data []*linodeEvent `json:"data"`
+		}
+		err := l.do(ctx, "GET", "/account/events", map[string]string{"X-Filter": filter}, nil, &result)
+		if err == nil {
+			err = result.err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Data) > 0 {
+			return result.Data[0], nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("no event found for action %q", action)
+		}
+		select {
+		case <-time.After(1 * time.Second):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 }
 
-func (l *linode) createDisk(server *linodeServer, image ImageID, password string) (root, swap *linodeDiskJob, err error) {
-	distro, err := l.distro(image)
+func (l *linode) createDisk(ctx context.Context, server *linodeServer, image ImageID, password string) (root, swap int, err error) {
+	distro, err := l.distro(ctx, image)
 	if err != nil {
-		return nil, nil, err
+		return 0, 0, err
 	}
 
 	logf("Creating disk on %s with %s...", server, image)
-	params := linodeParams{
-		"api_action": "batch",
-		"api_requestArray": []linodeParams{{
-			"api_action":     "linode.disk.createFromDistribution",
-			"LinodeID":       server.ID,
-			"DistributionID": distro.ID,
-			"Label":          image.Label("root"),
-			"Size":           4096,
-			"rootPass":       password,
-		}, {
-			"api_action": "linode.disk.create",
-			"LinodeID":   server.ID,
-			"Label":      image.Label("swap"),
-			"Size":       256,
-			"Type":       "swap",
-		}},
-	}
-
-	var results []linodeDiskJobResult
-	err = l.do(params, &results)
-	for i, result := range results {
-		if e := result.err(); e != nil {
-			err = e
-			break
-		}
-		if i == 0 {
-			root = result.Data
-			continue
-		}
-		swap = result.Data
-		return root, swap, nil
-	}
 
-	if root != nil {
-		l.removeDisks(server, root.DiskID)
+	var rootDisk struct {
+		linodeResult
+		ID int `json:"id"`
+	}
+	err = l.do(ctx, "POST", fmt.Sprintf("/linode/instances/%d/disks", server.ID), nil, linodeParams{
+		"label":           image.Label("root"),
+		"size":            4096,
+		"image":           distro.ID,
+		"root_pass":       password,
+		"authorized_keys": l.backend.RootSSHKeys,
+	}, &rootDisk)
+	if err == nil {
+		err = rootDisk.err()
 	}
-	if len(results) == 0 {
-		err = fmt.Errorf("empty batch result")
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot create Linode root disk with %s: %v", image, err)
 	}
-	return nil, nil, fmt.Errorf("cannot create Linode disk with %s: %v", image, err)
-}
 
-func (l *linode) removeDisks(server *linodeServer, diskIDs ...int) error {
-	logf("Removing disks from %s...", server)
-	var batch []linodeParams
-	for _, diskID := range diskIDs {
-		batch = append(batch, linodeParams{
-			"api_action": "linode.disk.delete",
-			"LinodeID":   server.ID,
-			"DiskID":     diskID,
-		})
-	}
-	params := linodeParams{
-		"api_action":       "batch",
-		"api_requestArray": batch,
-	}
-	var results []linodeResult
-	err := l.do(params, &results)
+	var swapDisk struct {
+		linodeResult
+		ID int `json:"id"`
+	}
+	err = l.do(ctx, "POST", fmt.Sprintf("/linode/instances/%d/disks", server.ID), nil, linodeParams{
+		"label":      image.Label("swap"),
+		"size":       256,
+		"filesystem": "swap",
+	}, &swapDisk)
+	if err == nil {
+		err = swapDisk.err()
+	}
 	if err != nil {
-		return fmt.Errorf("cannot remove disk on %s: %v", server, err)
+		l.removeDisks(ctx, server, rootDisk.ID)
+		return 0, 0, fmt.Errorf("cannot create Linode swap disk with %s: %v", image, err)
 	}
-	for _, result := range results {
-		if err := result.err(); err != nil {
-			return fmt.Errorf("cannot remove disk on %s: %v", server, err)
+
+	return rootDisk.ID, swapDisk.ID, nil
+}
+
+// doEach runs action(0), action(1), ..., action(n-1) in order, stopping at
+// the first error. v3's batch endpoint accepted up to 25 sub-requests in one
+// POST; v4 has no equivalent, so each action is its own HTTP call and there
+// is nothing left to cap a request count against.
+func (l *linode) doEach(n int, action func(i int) error) error {
+	for i := 0; i < n; i++ {
+		if err := action(i); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-type linodeConfigResult struct {
-	linodeResult
-	Data struct {
-		ConfigID int `json:"CONFIGID"`
-	} `json:"DATA"`
+func (l *linode) removeDisks(ctx context.Context, server *linodeServer, diskIDs ...int) error {
+	logf("Removing disks from %s...", server)
+	err := l.doEach(len(diskIDs), func(i int) error {
+		return l.do(ctx, "DELETE", fmt.Sprintf("/linode/instances/%d/disks/%d", server.ID, diskIDs[i]), nil, nil, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot remove disk on %s: %v", server, err)
+	}
+	return nil
 }
 
-func (l *linode) createConfig(server *linodeServer, image ImageID, rootID, swapID int) (configID int, err error) {
+func (l *linode) createConfig(ctx context.Context, server *linodeServer, image ImageID, rootID, swapID int) (configID int, err error) {
 	logf("Creating configuration on %s with %s...", server, image)
 
-	distro, err := l.distro(image)
+	distro, err := l.distro(ctx, image)
 	if err != nil {
 		return 0, err
 	}
 
-	params := linodeParams{
-		"api_action":             "linode.config.create",
-		"LinodeID":               server.ID,
-		"KernelID":               distro.KernelID,
-		"Label":                  image.Label(""),
-		"DiskList":               fmt.Sprintf("%d,%d", rootID, swapID),
-		"RootDeviceNum":          1,
-		"RootDeviceR0":           true,
-		"helper_disableUpdateDB": true,
-		"helper_distro":          true,
-		"helper_depmod":          true,
-		"helper_network":         false,
-		"devtmpfs_automount":     true,
-	}
-
-	var result linodeConfigResult
-	err = l.do(params, &result)
+	var result struct {
+		linodeResult
+		ID int `json:"id"`
+	}
+	err = l.do(ctx, "POST", fmt.Sprintf("/linode/instances/%d/configs", server.ID), nil, linodeParams{
+		"kernel": distro.KernelID,
+		"label":  image.Label(""),
+		"devices": linodeParams{
+			"sda": linodeParams{"disk_id": rootID},
+			"sdb": linodeParams{"disk_id": swapID},
+		},
+		"root_device": "/dev/sda",
+		"helpers": linodeParams{
+			"updatedb_disabled":  true,
+			"distro":             true,
+			"modules_dep":        true,
+			"network":            false,
+			"devtmpfs_automount": true,
+		},
+	}, &result)
 	if err == nil {
 		err = result.err()
 	}
 	if err != nil {
 		return 0, fmt.Errorf("cannot create config on %s with %s: %v", server, image, err)
 	}
-	return result.Data.ConfigID, nil
+	return result.ID, nil
 }
 
-func (l *linode) removeConfig(server *linodeServer, configID int) error {
+func (l *linode) removeConfig(ctx context.Context, server *linodeServer, configID int) error {
 	logf("Removing configuration from %s...", server)
 
-	params := linodeParams{
-		"api_action": "linode.config.delete",
-		"LinodeID":   server.ID,
-		"ConfigID":   configID,
-	}
-	var result linodeResult
-	err := l.do(params, &result)
-	if err == nil {
-		err = result.err()
-	}
+	err := l.do(ctx, "DELETE", fmt.Sprintf("/linode/instances/%d/configs/%d", server.ID, configID), nil, nil, nil)
 	if err != nil {
 		return fmt.Errorf("cannot remove config from %s: %v", server, err)
 	}
 	return nil
 }
 
-type linodeJobInfo struct {
-	JobID       int    `json:"JOBID"`
-	LinodeID    int    `json:"LINODEID"`
-	Action      string `json:"ACTION"`
-	Label       string `json:"LABEL"`
-	HostStart   string `json:"HOST_START_DT"`
-	HostFinish  string `json:"HOST_FINISH_DT"`
-	HostSuccess int    `json:"HOST_SUCCESS"`
-	HostMessage string `json:"HOST_MESSAGE"`
-}
-
-func (job *linodeJobInfo) err() error {
-	if job.HostSuccess == 1 || job.HostFinish == "" {
-		return nil
-	}
-	if msg := job.HostMessage; msg != "" {
-		return fmt.Errorf("%s", strings.ToLower(string(msg[0]))+msg[1:])
-	}
-	return fmt.Errorf("job %d failed silently", job.JobID)
-}
-
-type linodeJobInfoResult struct {
-	linodeResult
-	Data []*linodeJobInfo `json:"DATA"`
-}
-
-func (l *linode) jobInfo(server *linodeServer, jobID int) (*linodeJobInfo, error) {
-	params := linodeParams{
-		"api_action": "linode.job.list",
-		"LinodeID":   server.ID,
-		"JobID":      jobID,
-	}
-	var result linodeJobInfoResult
-	err := l.do(params, &result)
-	if err == nil {
-		err = result.err()
-	}
-	if err == nil && len(result.Data) == 0 {
-		err = fmt.Errorf("empty result")
-	}
-	if err != nil {
-		return nil, fmt.Errorf("cannot get job details for %s: %v", server, err)
-	}
-	return result.Data[0], nil
-}
-
-func (l *linode) waitJob(server *linodeServer, verb string, jobID int) (*linodeJobInfo, error) {
+func (l *linode) waitEvent(ctx context.Context, server *linodeServer, verb string, event *linodeEvent, timeout time.Duration) error {
 	logf("Waiting for %s to %s...", server, verb)
 
-	timeout := time.After(1 * time.Minute)
+	deadline := time.After(timeout)
 	retry := time.NewTicker(5 * time.Second)
 	defer retry.Stop()
 
 	var infoErr error
 	for {
 		select {
-		case <-timeout:
-			// Don't shutdown. The machine may be running something else.
+		case <-deadline:
 			if infoErr != nil {
-				return nil, infoErr
+				return infoErr
 			}
-			l.removeConfig(server, server.Config)
-			l.removeDisks(server, server.Root, server.Swap)
-			return nil, fmt.Errorf("timeout waiting for %s to %s", server, verb)
+			return fmt.Errorf("timeout waiting for %s to %s", server, verb)
 
 		case <-retry.C:
-			job, err := l.jobInfo(server, jobID)
+			var result linodeEvent
+			err := l.do(ctx, "GET", fmt.Sprintf("/account/events/%d", event.ID), nil, nil, &result)
 			if err != nil {
 				infoErr = fmt.Errorf("cannot %s %s: %s", verb, server, err)
 				break
 			}
-			if job.HostFinish != "" {
-				err := job.err()
-				if err != nil {
-					err = fmt.Errorf("cannot %s %s: %s", verb, server, err)
-				}
-				return job, err
+			switch result.Status {
+			case "finished":
+				return nil
+			case "failed":
+				return fmt.Errorf("cannot %s %s: %s", verb, server, result.Message)
 			}
 		}
 	}
 	panic("unreachable")
 }
 
-type linodeIPResult struct {
-	linodeResult
-	Data []*linodeIP `json:"DATA"`
-}
-
-type linodeIP struct {
-	ID        int    `json:"IPADDRESSID"`
-	LinodeID  int    `json:"LINODEID"`
-	IsPublic  int    `json:"ISPUBLIC"`
-	IPAddress string `json:"IPADDRESS"`
-	RDNSName  string `json:"RDNS_NAME"`
-}
-
-func (l *linode) ip(server *linodeServer) (*linodeIP, error) {
+func (l *linode) ip(ctx context.Context, server *linodeServer) (string, error) {
 	logf("Obtaining address of %s...", server)
 
-	params := linodeParams{
-		"api_action": "linode.ip.list",
-		"LinodeID":   server.ID,
+	var result struct {
+		linodeResult
+		IPv4 struct {
+			Public []struct {
+				Address string `json:"address"`
+			} `json:"public"`
+		} `json:"ipv4"`
 	}
-	var result linodeIPResult
-	err := l.do(params, &result)
+	err := l.do(ctx, "GET", fmt.Sprintf("/linode/instances/%d/ips", server.ID), nil, nil, &result)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	if err := result.err(); err != nil {
-		return nil, fmt.Errorf("cannot list IPs for %s: %v", server, err)
+		return "", fmt.Errorf("cannot list IPs for %s: %v", server, err)
 	}
-	for _, ip := range result.Data {
-		if ip.IsPublic == 1 {
-			logf("Got address of %s: %s", server, ip.IPAddress)
-			return ip, nil
-		}
+	if len(result.IPv4.Public) == 0 {
+		return "", fmt.Errorf("cannot find public IP for %s", server)
 	}
-	return nil, fmt.Errorf("cannot find public IP for %s", server)
-}
-
-type distrosResult struct {
-	linodeResult
-	Data []*linodeDistro
+	addr := result.IPv4.Public[0].Address
+	logf("Got address of %s: %s", server, addr)
+	return addr, nil
 }
 
-type linodeDistro struct {
+type linodeImage struct {
 	Name     string `json:"-"`
-	KernelID int    `json:"-"`
+	KernelID string `json:"-"`
 
-	ID           int    `json:"DISTRIBUTIONID"`
-	Label        string `json:"LABEL"`
-	MinImageSize int    `json:"MINIMAGESIZE"`
-	VOPSKernel   int    `json:"REQUIRESVOPSKERNEL"`
-	Is64Bit      int    `json:"IS64BIT"`
-	Create       string `json:"CREATE_DT"`
+	ID         string `json:"id"`
+	Label      string `json:"label"`
+	Vendor     string `json:"vendor"`
+	Deprecated bool   `json:"deprecated"`
 }
 
-type kernelsResult struct {
-	linodeResult
-	Data []*linodeKernel
+type linodeKernel struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	Arch  string `json:"architecture"`
+	KVM   bool   `json:"kvm"`
 }
 
-type linodeKernel struct {
-	ID      int    `json:"KERNELID"`
-	IsPVOPS int    `json:"ISPVOPS"`
-	IsXEN   int    `json:"ISXEN"`
-	IsKVM   int    `json:"ISKVM"`
-	Label   string `json:"LABEL"`
+func isPrivateImage(image ImageID) bool {
+	s := string(image)
+	return strings.HasPrefix(s, "private/") || strings.HasPrefix(s, "private-")
 }
 
-func (l *linode) distro(image ImageID) (*linodeDistro, error) {
+func (l *linode) distro(ctx context.Context, image ImageID) (*linodeImage, error) {
 	l.distrosLock.Lock()
 	defer l.distrosLock.Unlock()
 
 	if !l.distrosDone {
-		if err := l.cacheDistros(); err != nil {
+		if err := l.cacheImages(ctx); err != nil {
 			return nil, err
 		}
+		l.distrosDone = true
+	}
+
+	if isPrivateImage(image) {
+		return &linodeImage{ID: string(image), KernelID: l.genericKernel}, nil
 	}
-	l.distrosDone = true
 
 	var system = string(image.SystemID())
-	var best *linodeDistro
-	for _, distro := range l.distrosCache {
-		if distro.Name != system {
-			continue
-		}
-		if distro.Is64Bit == 1 {
-			return distro, nil
+	for _, img := range l.imagesCache {
+		if img.Name == system {
+			return img, nil
 		}
-		best = distro
 	}
-	if best == nil {
-		return nil, fmt.Errorf("cannot find system %s in Linode")
-	}
-	return best, nil
+	return nil, fmt.Errorf("cannot find system %s in Linode", system)
 }
 
-func (l *linode) cacheDistros() error {
-	var err error
-	for retry := 0; retry < 3; retry++ {
-		params := linodeParams{
-			"api_action": "avail.distributions",
-		}
-		var result distrosResult
-		err = l.do(params, &result)
-		if err == nil {
-			err = result.err()
-		}
-		if err == nil {
-			l.distrosCache = result.Data
-			break
-		}
+func (l *linode) cacheImages(ctx context.Context) error {
+	var result struct {
+		linodeResult
+		Data []*linodeImage `json:"data"`
+	}
+	err := l.do(ctx, "GET", "/images?page_size=200", nil, nil, &result)
+	if err == nil {
+		err = result.err()
 	}
 	if err != nil {
-		return fmt.Errorf("cannot list Linode distributions: %v", err)
+		return fmt.Errorf("cannot list Linode images: %v", err)
 	}
-	for retry := 0; retry < 3; retry++ {
-		params := linodeParams{
-			"api_action": "avail.kernels",
-		}
-		var result kernelsResult
-		err = l.do(params, &result)
-		if err == nil {
-			err = result.err()
-		}
-		if err == nil {
-			l.kernelsCache = result.Data
-			break
-		}
+	l.imagesCache = result.Data
+
+	var kresult struct {
+		linodeResult
+		Data []*linodeKernel `json:"data"`
+	}
+	err = l.do(ctx, "GET", "/linode/kernels?page_size=200", nil, nil, &kresult)
+	if err == nil {
+		err = kresult.err()
 	}
 	if err != nil {
 		return fmt.Errorf("cannot list Linode kernels: %v", err)
 	}
+	l.kernelsCache = kresult.Data
 
-	var latest32 = -1
-	var latest64 = -1
 	for _, kernel := range l.kernelsCache {
-		if strings.HasPrefix(kernel.Label, "Latest 64 bit") {
-			latest64 = kernel.ID
-		}
-		if strings.HasPrefix(kernel.Label, "Latest 32 bit") {
-			latest32 = kernel.ID
+		if kernel.KVM && strings.HasPrefix(kernel.Label, "GRUB 2") {
+			l.genericKernel = kernel.ID
+			break
 		}
 	}
-	if latest32 == -1 || latest64 == -1 {
-		return fmt.Errorf("cannot find latest Linode kernel")
+	if l.genericKernel == "" {
+		return fmt.Errorf("cannot find generic Linode kernel")
 	}
-	for _, distro := range l.distrosCache {
-		if distro.Is64Bit == 1 {
-			distro.KernelID = latest64
-		} else {
-			distro.KernelID = latest32
-		}
 
-		label := strings.Fields(strings.ToLower(distro.Label))
-		if len(label) > 2 && label[1] == "linux" {
-			distro.Name = label[0] + "-" + label[2]
-		} else {
-			distro.Name = label[0] + "-" + label[1]
+	for _, img := range l.imagesCache {
+		if img.Vendor == "" || img.Deprecated {
+			continue
+		}
+		img.KernelID = l.genericKernel
+
+		label := strings.Fields(strings.ToLower(img.Label))
+		switch {
+		case len(label) > 2 && label[1] == "linux":
+			img.Name = label[0] + "-" + label[2]
+		case len(label) > 1:
+			img.Name = label[0] + "-" + label[1]
 		}
 	}
 
-	debugf("Linode distributions available: %# v", l.distrosCache)
+	debugf("Linode images available: %# v", l.imagesCache)
 	return nil
 }
 
 type linodeParams map[string]interface{}
 
-func (l *linode) do(params linodeParams, result interface{}) error {
-	debugf("Linode request: %# v\n", params)
-
-	values := make(url.Values)
-	for k, v := range params {
-		var vs string
-		switch v := v.(type) {
-		case int:
-			vs = strconv.Itoa(v)
-		case string:
-			vs = v
-		default:
-			data, err := json.Marshal(v)
-			if err != nil {
-				return fmt.Errorf("cannot marshal Linode request parameter %q: %s", k, err)
-			}
-			vs = string(data)
+// linodeMinBackoff, linodeMaxBackoff and linodeRetryBudget tune how do
+// retries transient failures: a base wait of 1s, 2s, 4s, 8s, ... capped at
+// 30s, each varied by up to 25% either way (see jitter), or the server's
+// Retry-After when it sends one, for up to two minutes by default, unless
+// the backend overrides the budget.
+const (
+	linodeMinBackoff  = 1 * time.Second
+	linodeMaxBackoff  = 30 * time.Second
+	linodeRetryBudget = 2 * time.Minute
+)
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case 429, 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+func isRetryableErr(err error) bool {
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if nerr, ok := err.(net.Error); ok {
+		return nerr.Temporary() || nerr.Timeout()
+	}
+	return false
+}
+
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()-0.5)*0.5*float64(d))
+}
+
+func retryAfter(h http.Header) time.Duration {
+	secs, err := strconv.Atoi(h.Get("Retry-After"))
+	if err != nil || secs <= 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+func (l *linode) do(ctx context.Context, method, path string, headers map[string]string, body, result interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("cannot marshal Linode request body: %v", err)
 		}
-		values[k] = []string{vs}
 	}
-	values["api_key"] = []string{l.backend.Key}
 
-	resp, err := client.PostForm("https://api.linode.com", values)
-	if err != nil {
-		return fmt.Errorf("cannot perform Linode request: %v", err)
+	budget := l.backend.RetryTimeout
+	if budget == 0 {
+		budget = linodeRetryBudget
 	}
-	defer resp.Body.Close()
+	deadline := time.Now().Add(budget)
+	backoff := linodeMinBackoff
 
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("cannot read Linode response: %v", err)
+	for {
+		debugf("Linode request: %s %s %s\n", method, path, data)
+
+		req, err := http.NewRequest(method, linodeBaseURL+path, bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("cannot create Linode request: %v", err)
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+l.backend.Key)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, respErr := client.Do(req)
+		var respData []byte
+		var wait time.Duration
+		if respErr == nil {
+			respData, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				respErr = err
+			} else if isRetryableStatus(resp.StatusCode) {
+				wait = retryAfter(resp.Header)
+			}
+		}
+
+		retry := false
+		if respErr != nil {
+			retry = isRetryableErr(respErr)
+		} else if isRetryableStatus(resp.StatusCode) {
+			retry = true
+		}
+
+		if !retry {
+			if respErr != nil {
+				return fmt.Errorf("cannot perform Linode request: %v", respErr)
+			}
+			return l.decode(resp, respData, result)
+		}
+
+		if wait == 0 {
+			wait = jitter(backoff)
+			backoff *= 2
+			if backoff > linodeMaxBackoff {
+				backoff = linodeMaxBackoff
+			}
+		}
+		if time.Now().Add(wait).After(deadline) {
+			if respErr != nil {
+				return fmt.Errorf("cannot perform Linode request: %v", respErr)
+			}
+			var errResult linodeResult
+			if len(respData) > 0 {
+				json.Unmarshal(respData, &errResult)
+			}
+			if err := errResult.err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("Linode request failed with status %s", resp.Status)
+		}
+
+		logf("Linode request to %s failed, retrying in %s...", path, wait.Round(time.Second))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+}
 
-	if Debug {
+func (l *linode) decode(resp *http.Response, data []byte, result interface{}) error {
+	if Debug && len(data) > 0 {
 		var r interface{}
-		err = json.Unmarshal(data, &r)
-		if err != nil {
+		if err := json.Unmarshal(data, &r); err != nil {
 			return fmt.Errorf("cannot decode Linode response: %v", err)
 		}
 		debugf("Linode response: %# v\n", r)
 	}
 
-	err = json.Unmarshal(data, result)
-	if err != nil {
+	if resp.StatusCode >= 400 {
+		var errResult linodeResult
+		if len(data) > 0 {
+			json.Unmarshal(data, &errResult)
+		}
+		if err := errResult.err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("Linode request failed with status %s", resp.Status)
+	}
+
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, result); err != nil {
 		return fmt.Errorf("cannot decode Linode response: %v", err)
 	}
 	return nil
@@ -0,0 +1,54 @@
+package spread
+
+import "testing"
+
+// v3's batch endpoint accepted up to 25 sub-requests in one POST; v4 has no
+// equivalent, so doEach is just a sequential, in-order, stop-on-first-error
+// loop over one HTTP call per action. This test checks that contract rather
+// than counting POSTs, since there are no batched POSTs to count.
+func TestDoEachSequentialInOrder(t *testing.T) {
+	l := &linode{}
+
+	const n = 60
+	var seen []int
+	err := l.doEach(n, func(i int) error {
+		seen = append(seen, i)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("doEach returned error: %v", err)
+	}
+	if len(seen) != n {
+		t.Fatalf("expected %d calls, got %d", n, len(seen))
+	}
+	for i, v := range seen {
+		if v != i {
+			t.Fatalf("expected call %d to run action(%d), got action(%d)", i, i, v)
+		}
+	}
+}
+
+func TestDoEachStopsOnFirstError(t *testing.T) {
+	l := &linode{}
+
+	var seen []int
+	err := l.doEach(10, func(i int) error {
+		seen = append(seen, i)
+		if i == 3 {
+			return errTest
+		}
+		return nil
+	})
+	if err != errTest {
+		t.Fatalf("expected errTest, got %v", err)
+	}
+	if len(seen) != 4 {
+		t.Fatalf("expected doEach to stop after the failing call, ran %d", len(seen))
+	}
+}
+
+var errTest = &testError{"boom"}
+
+type testError struct{ msg string }
+
+func (e *testError) Error() string { return e.msg }